@@ -21,8 +21,11 @@ import (
 	"fmt"
 	"io"
 	"sort"
+	"strconv"
+	"unsafe"
 
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
 
 	"github.com/cortexproject/cortex/pkg/prom1/storage/metric"
 )
@@ -41,25 +44,29 @@ var (
 // Encoding defines which encoding we are using, delta, doubledelta, or varbit
 type Encoding byte
 
-// String implements flag.Value.
+// String implements flag.Value. It returns the encoding's registered name,
+// or its numeric byte if nothing is registered under that id yet.
 func (e Encoding) String() string {
-	return fmt.Sprintf("%d", e)
+	return nameForEncoding(e)
 }
 
-// Set implements flag.Value.
+// Set implements flag.Value. It accepts either the numeric id or the
+// registered name of an encoding, so command-line flags become
+// self-documenting (e.g. "-store.chunk-encoding=bigchunk" as well as
+// "-store.chunk-encoding=3").
 func (e *Encoding) Set(s string) error {
-	switch s {
-	case "0":
-		*e = Delta
-	case "1":
-		*e = DoubleDelta
-	case "2":
-		*e = Varbit
-	case "3":
-		*e = Bigchunk
-	default:
+	if id, err := LookupByName(s); err == nil {
+		*e = id
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid chunk encoding: %s", s)
+	}
+	if _, err := Lookup(Encoding(n)); err != nil {
 		return fmt.Errorf("invalid chunk encoding: %s", s)
 	}
+	*e = Encoding(n)
 	return nil
 }
 
@@ -72,24 +79,59 @@ const (
 	Varbit
 	// Bigchunk encoding
 	Bigchunk
+	// PrometheusHistogramChunk wraps Prometheus's native histogram chunk encoding.
+	PrometheusHistogramChunk
 )
 
+// ValueType distinguishes the kind of sample an Iterator or Batch currently
+// points at. Most encodings only ever produce ValueFloat; histogram-aware
+// encodings (see PrometheusHistogramChunk) can also produce the histogram
+// variants.
+type ValueType int
+
+const (
+	// ValueFloat is a plain float64 sample, accessed via Iterator.Value.
+	ValueFloat ValueType = iota
+	// ValueHistogram is a sparse histogram sample, accessed via Iterator.AtHistogram.
+	ValueHistogram
+	// ValueFloatHistogram is a float histogram sample, accessed via Iterator.AtFloatHistogram.
+	ValueFloatHistogram
+)
+
+// errHistogramsNotSupported is returned by AddHistogram on encodings that
+// only ever carry float samples.
+var errHistogramsNotSupported = errors.New("encoding does not support histogram samples")
+
 // Chunk is the interface for all chunks. Chunks are generally not
 // goroutine-safe.
 type Chunk interface {
-	// Add adds a SamplePair to the chunks, performs any necessary
-	// re-encoding, and adds any necessary overflow chunks. It returns the
-	// new version of the original chunk, followed by overflow chunks, if
-	// any. The first chunk returned might be the same as the original one
-	// or a newly allocated version. In any case, take the returned chunk as
-	// the relevant one and discard the original chunk.
-	Add(sample model.SamplePair) ([]Chunk, error)
+	// Add adds a SamplePair to the chunk, mutating the receiver in place and
+	// performing any necessary re-encoding. It returns nil if the sample fit
+	// in the receiver, or a single newly allocated overflow chunk if it
+	// didn't. Callers no longer need to discard the receiver and pick a
+	// "new" chunk out of a returned slice; the receiver is always the
+	// chunk to keep using. Add always returns an error on Delta, which is
+	// read-only, and on PrometheusHistogramChunk, which only carries
+	// histogram samples.
+	Add(sample model.SamplePair) (Chunk, error)
+
+	// AddHistogram is the histogram-sample counterpart to Add, with the same
+	// mutate-in-place-and-return-overflow contract. Encodings that don't
+	// carry histograms (e.g. DoubleDelta, Varbit, Bigchunk) return
+	// errHistogramsNotSupported, and read-only Delta returns
+	// errDeltaReadOnly; only PrometheusHistogramChunk implements it for real.
+	AddHistogram(t model.Time, h *histogram.Histogram) (Chunk, error)
+
 	NewIterator() Iterator
 	Marshal(io.Writer) error
 	UnmarshalFromBuf([]byte) error
 	Encoding() Encoding
 	Utilization() float64
 
+	// ValueType reports the type of sample this chunk stores. It is constant
+	// for the lifetime of the chunk.
+	ValueType() ValueType
+
 	// Slice returns a smaller chunk the includes all samples between start and end
 	// (inclusive).  Its may over estimate. On some encodings it is a noop.
 	Slice(start, end model.Time) Chunk
@@ -120,11 +162,32 @@ type Iterator interface {
 	// of the find... methods). It returns model.ZeroSamplePair before any of
 	// those methods were called.
 	Value() model.SamplePair
+	// AtHistogram returns the last histogram scanned or found. It panics on
+	// iterators over float-only chunks; on histogram chunks it returns a nil
+	// histogram if the current sample is a float histogram. Value, in turn,
+	// panics on iterators over histogram chunks.
+	AtHistogram() (model.Time, *histogram.Histogram)
+	// AtFloatHistogram returns the last float histogram scanned or found. It
+	// panics on iterators over float-only chunks; on histogram chunks it
+	// returns a nil float histogram if the current sample is not one.
+	AtFloatHistogram() (model.Time, *histogram.FloatHistogram)
 	// Returns a batch of the provisded size; NB not idempotent!  Should only be called
 	// once per Scan.
 	Batch(size int) Batch
+	// FillBatch positions the iterator at the first value at or after from,
+	// then fills out (up to len(out.Timestamps) values) starting there. It
+	// reports whether it found any values at all. Unlike Batch, FillBatch
+	// owns its own positioning: it does not require a preceding Scan or
+	// FindAtOrAfter call, and it fills the caller-provided Batch instead of
+	// returning one by value, which keeps size and copy overhead off the
+	// per-sample hot path in PromQL selectors.
+	FillBatch(from model.Time, out *Batch) bool
 	// Returns the last error encountered. In general, an error signals data
-	// corruption in the chunk and requires quarantining.
+	// corruption in the chunk and requires quarantining: the iterators in
+	// this package route the offending chunk through the QuarantineFunc
+	// installed via SetQuarantineFunc the first time they report an error
+	// here. Checksum mismatches (see verifyChecksummed) are reported, and
+	// quarantined, by UnmarshalFromBuf instead.
 	Err() error
 }
 
@@ -134,69 +197,98 @@ const BatchSize = 12
 
 // Batch is a sorted set of (timestamp, value) pairs.  They are intended to be
 // small, and passed by value.
+//
+// PointerValues carries non-float samples (currently *histogram.Histogram or
+// *histogram.FloatHistogram, as indicated by ValueType) so that
+// histogram-aware encodings can fill a Batch without inflating Values for
+// the common float-only case.
 type Batch struct {
-	Timestamps [BatchSize]int64
-	Values     [BatchSize]float64
-	Index      int
-	Length     int
+	Timestamps    [BatchSize]int64
+	Values        [BatchSize]float64
+	PointerValues [BatchSize]unsafe.Pointer
+	ValueType     ValueType
+	Index         int
+	Length        int
 }
 
 // RangeValues is a utility function that retrieves all values within the given
-// range from an Iterator.
+// range from an Iterator, via FillBatch so it doesn't pay for a value-at-a-time
+// interface call per sample.
 func RangeValues(it Iterator, in metric.Interval) ([]model.SamplePair, error) {
 	result := []model.SamplePair{}
-	if !it.FindAtOrAfter(in.OldestInclusive) {
-		return result, it.Err()
-	}
-	for !it.Value().Timestamp.After(in.NewestInclusive) {
-		result = append(result, it.Value())
-		if !it.Scan() {
-			break
+	var batch Batch
+	from := in.OldestInclusive
+	for it.FillBatch(from, &batch) {
+		if batch.ValueType != ValueFloat {
+			return nil, fmt.Errorf("RangeValues does not support %v samples, use the Iterator directly", batch.ValueType)
 		}
+		for i := 0; i < batch.Length; i++ {
+			ts := model.Time(batch.Timestamps[i])
+			if ts.After(in.NewestInclusive) {
+				return result, it.Err()
+			}
+			result = append(result, model.SamplePair{
+				Timestamp: ts,
+				Value:     model.SampleValue(batch.Values[i]),
+			})
+		}
+		from = model.Time(batch.Timestamps[batch.Length-1]) + 1
 	}
 	return result, it.Err()
 }
 
-// addToOverflowChunk is a utility function that creates a new chunk as overflow
-// chunk, adds the provided sample to it, and returns a chunk slice containing
-// the provided old chunk followed by the new overflow chunk.
-func addToOverflowChunk(c Chunk, s model.SamplePair) ([]Chunk, error) {
-	overflowChunks, err := New().Add(s)
-	if err != nil {
+// addToOverflowChunk is a utility function that creates a new chunk, adds the
+// provided sample to it, and returns it as the overflow chunk to place after
+// the chunk that overflowed. The new chunk is guaranteed to have room for s,
+// since it starts empty.
+func addToOverflowChunk(s model.SamplePair) (Chunk, error) {
+	overflow := New()
+	if overflowChunk, err := overflow.Add(s); err != nil {
 		return nil, err
+	} else if overflowChunk != nil {
+		// New, empty chunks always have room for one sample.
+		return nil, errors.New("unexpected overflow while adding to a fresh overflow chunk")
 	}
-	return []Chunk{c, overflowChunks[0]}, nil
+	return overflow, nil
 }
 
-// transcodeAndAdd is a utility function that transcodes the dst chunk into the
-// provided src chunk (plus the necessary overflow chunks) and then adds the
-// provided sample. It returns the new chunks (transcoded plus overflow) with
-// the new sample at the end.
+// transcodeAndAdd is a utility function that transcodes the samples of the
+// provided src chunk into the dst chunk and then adds the provided sample.
+// dst is mutated in place. It returns dst followed, in order, by any
+// overflow chunks created when dst or a later chunk filled up; the sample
+// lives in the last returned chunk.
 func transcodeAndAdd(dst Chunk, src Chunk, s model.SamplePair) ([]Chunk, error) {
 	Ops.WithLabelValues(Transcode).Inc()
 
 	var (
-		head            = dst
-		body, NewChunks []Chunk
-		err             error
+		head       = dst
+		overflow   []Chunk
+		next, over Chunk
+		err        error
 	)
 
 	it := src.NewIterator()
 	for it.Scan() {
-		if NewChunks, err = head.Add(it.Value()); err != nil {
+		if next, err = head.Add(it.Value()); err != nil {
 			return nil, err
 		}
-		body = append(body, NewChunks[:len(NewChunks)-1]...)
-		head = NewChunks[len(NewChunks)-1]
+		if next != nil {
+			overflow = append(overflow, head)
+			head = next
+		}
 	}
 	if it.Err() != nil {
 		return nil, it.Err()
 	}
 
-	if NewChunks, err = head.Add(s); err != nil {
+	if over, err = head.Add(s); err != nil {
 		return nil, err
 	}
-	return append(body, NewChunks...), nil
+	overflow = append(overflow, head)
+	if over != nil {
+		overflow = append(overflow, over)
+	}
+	return overflow, nil
 }
 
 // New creates a new chunk according to the encoding set by the
@@ -209,20 +301,15 @@ func New() Chunk {
 	return chunk
 }
 
-// NewForEncoding allows configuring what chunk type you want
+// NewForEncoding allows configuring what chunk type you want. Encodings are
+// looked up in the registry (see Register), so downstream projects can add
+// their own without touching this function.
 func NewForEncoding(encoding Encoding) (Chunk, error) {
-	switch encoding {
-	case Delta:
-		return newDeltaEncodedChunk(d1, d0, true, ChunkLen), nil
-	case DoubleDelta:
-		return newDoubleDeltaEncodedChunk(d1, d0, true, ChunkLen), nil
-	case Varbit:
-		return newVarbitChunk(varbitZeroEncoding), nil
-	case Bigchunk:
-		return newBigchunk(), nil
-	default:
-		return nil, fmt.Errorf("unknown chunk encoding: %v", encoding)
+	factory, err := Lookup(encoding)
+	if err != nil {
+		return nil, err
 	}
+	return factory(), nil
 }
 
 // indexAccessor allows accesses to samples by index.
@@ -235,14 +322,21 @@ type indexAccessor interface {
 // indexAccessingChunkIterator is a chunk iterator for chunks for which an
 // indexAccessor implementation exists.
 type indexAccessingChunkIterator struct {
-	len       int
-	pos       int
-	lastValue model.SamplePair
-	acc       indexAccessor
+	c           Chunk
+	len         int
+	pos         int
+	lastValue   model.SamplePair
+	acc         indexAccessor
+	quarantined bool
 }
 
-func newIndexAccessingChunkIterator(len int, acc indexAccessor) *indexAccessingChunkIterator {
+// newIndexAccessingChunkIterator builds an iterator over acc, which backs
+// the len samples in c. c is kept only so Err() can hand it to
+// QuarantineFunc if acc reports corruption; callers pass the same
+// concrete chunk that implements acc.
+func newIndexAccessingChunkIterator(c Chunk, len int, acc indexAccessor) *indexAccessingChunkIterator {
 	return &indexAccessingChunkIterator{
+		c:         c,
 		len:       len,
 		pos:       -1,
 		lastValue: model.ZeroSamplePair,
@@ -284,6 +378,59 @@ func (it *indexAccessingChunkIterator) Value() model.SamplePair {
 	return it.lastValue
 }
 
+// AtHistogram implements Iterator. indexAccessingChunkIterator only ever
+// backs float encodings, so this always panics.
+func (it *indexAccessingChunkIterator) AtHistogram() (model.Time, *histogram.Histogram) {
+	panic("AtHistogram called on a float-only chunk iterator")
+}
+
+// AtFloatHistogram implements Iterator. indexAccessingChunkIterator only
+// ever backs float encodings, so this always panics.
+func (it *indexAccessingChunkIterator) AtFloatHistogram() (model.Time, *histogram.FloatHistogram) {
+	panic("AtFloatHistogram called on a float-only chunk iterator")
+}
+
+// FillBatch implements Iterator. It positions the iterator itself via
+// sort.Search rather than relying on a prior Scan/FindAtOrAfter call, so
+// unlike Batch it needs no decrement hack to stay call-order agnostic.
+func (it *indexAccessingChunkIterator) FillBatch(from model.Time, out *Batch) bool {
+	pos := sort.Search(it.len, func(i int) bool {
+		return !it.acc.timestampAtIndex(i).Before(from)
+	})
+	if pos >= it.len || it.acc.err() != nil {
+		out.Length = 0
+		return false
+	}
+
+	j := 0
+	for j < len(out.Timestamps) && pos < it.len {
+		out.Timestamps[j] = int64(it.acc.timestampAtIndex(pos))
+		out.Values[j] = float64(it.acc.sampleValueAtIndex(pos))
+		pos++
+		j++
+	}
+	if it.acc.err() != nil {
+		return false
+	}
+	out.Index = 0
+	out.Length = j
+	out.ValueType = ValueFloat
+
+	// Leave the iterator positioned at the last value we filled, matching
+	// the convention Scan/FindAtOrAfter leave it in, so a subsequent Scan
+	// continues where FillBatch left off.
+	it.pos = pos - 1
+	it.lastValue = model.SamplePair{
+		Timestamp: it.acc.timestampAtIndex(it.pos),
+		Value:     it.acc.sampleValueAtIndex(it.pos),
+	}
+	return true
+}
+
+// Batch implements Iterator.
+//
+// Deprecated: prefer FillBatch, which fills a caller-owned Batch instead of
+// returning one by value and doesn't require a preceding Scan call.
 func (it *indexAccessingChunkIterator) Batch(size int) Batch {
 	var batch Batch
 	j := 0
@@ -298,10 +445,21 @@ func (it *indexAccessingChunkIterator) Batch(size int) Batch {
 	it.pos--
 	batch.Index = 0
 	batch.Length = j
+	batch.ValueType = ValueFloat
 	return batch
 }
 
-// err implements Iterator.
+// Err implements Iterator. Per the interface contract, a non-nil error here
+// signals data corruption, so it routes the chunk through the installed
+// QuarantineFunc (see SetQuarantineFunc) the first time it's observed. The
+// raw bytes aren't cheaply available from here, unlike the histogram chunk's
+// Bytes(), so they're passed as nil; the chunk itself is enough for an
+// operator to re-marshal it for forensics.
 func (it *indexAccessingChunkIterator) Err() error {
-	return it.acc.err()
+	err := it.acc.err()
+	if err != nil && !it.quarantined {
+		it.quarantined = true
+		quarantine(it.c, nil, err)
+	}
+	return err
 }
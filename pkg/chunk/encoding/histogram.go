@@ -0,0 +1,265 @@
+package encoding
+
+import (
+	"errors"
+	"io"
+	"unsafe"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// errFloatsNotSupported is returned by Add on a chunk that only ever carries
+// histogram samples.
+var errFloatsNotSupported = errors.New("PrometheusHistogramChunk does not support float samples, use AddHistogram")
+
+// prometheusHistogramChunk adapts Prometheus's chunkenc.HistogramChunk to the
+// Chunk interface, so that native histograms can flow through the same
+// storage and querying paths as the float-only encodings.
+type prometheusHistogramChunk struct {
+	chunk *chunkenc.HistogramChunk
+	app   chunkenc.Appender
+}
+
+func newPrometheusHistogramChunk() *prometheusHistogramChunk {
+	c := chunkenc.NewHistogramChunk()
+	app, err := c.Appender()
+	if err != nil {
+		// NewHistogramChunk always returns an empty, appendable chunk; an
+		// error here would mean chunkenc itself is broken.
+		panic(err)
+	}
+	return &prometheusHistogramChunk{chunk: c, app: app}
+}
+
+// Add implements Chunk. Native histogram chunks never carry float samples;
+// this exists only to satisfy the interface's compatibility shim.
+func (p *prometheusHistogramChunk) Add(sample model.SamplePair) (Chunk, error) {
+	return nil, errFloatsNotSupported
+}
+
+// AddHistogram implements Chunk. It mutates the receiver in place and
+// returns nil, or returns a newly allocated overflow chunk holding the
+// sample when AppendHistogram cuts a new chunk for it. The receiver's size
+// is not checked here.
+//
+// AppendHistogram can hand back a non-nil chunk for two different reasons:
+// recoded==true means it in-place recoded the receiver into a wider-schema
+// chunk carrying all of the receiver's samples plus the new one, so that
+// chunk *replaces* the receiver. recoded==false means it's a genuinely new
+// overflow chunk that should be appended after the receiver.
+func (p *prometheusHistogramChunk) AddHistogram(t model.Time, h *histogram.Histogram) (Chunk, error) {
+	newChunk, recoded, newApp, err := p.app.AppendHistogram(nil, int64(t), h, false)
+	if err != nil {
+		return nil, err
+	}
+	if newChunk == nil {
+		p.app = newApp
+		return nil, nil
+	}
+	if recoded {
+		p.chunk = newChunk.(*chunkenc.HistogramChunk)
+		p.app = newApp
+		return nil, nil
+	}
+	return &prometheusHistogramChunk{chunk: newChunk.(*chunkenc.HistogramChunk), app: newApp}, nil
+}
+
+func (p *prometheusHistogramChunk) NewIterator() Iterator {
+	return &prometheusHistogramIterator{c: p, it: p.chunk.Iterator(nil)}
+}
+
+// Marshal implements Chunk. It always writes a checksummed frame; the
+// checksum flag lets UnmarshalFromBuf tell that apart from the
+// unchecksummed chunks other encodings may still write.
+func (p *prometheusHistogramChunk) Marshal(w io.Writer) error {
+	if _, err := w.Write([]byte{checksumFlag}); err != nil {
+		return err
+	}
+	return writeChecksummed(w, p.chunk.Bytes())
+}
+
+// UnmarshalFromBuf implements Chunk. It's backward compatible with
+// unchecksummed frames: only bufs whose header has checksumFlag set are
+// verified.
+func (p *prometheusHistogramChunk) UnmarshalFromBuf(buf []byte) error {
+	if len(buf) < 1 {
+		return errors.New("empty buffer decoding PrometheusHistogramChunk")
+	}
+	header, body := buf[0], buf[1:]
+	if header&checksumFlag != 0 {
+		var err error
+		if body, err = verifyChecksummed(p, body); err != nil {
+			return err
+		}
+	}
+
+	c, err := chunkenc.FromData(chunkenc.EncHistogram, body)
+	if err != nil {
+		return err
+	}
+	hc, ok := c.(*chunkenc.HistogramChunk)
+	if !ok {
+		return errors.New("unexpected chunk type decoding PrometheusHistogramChunk")
+	}
+	p.chunk = hc
+	app, err := hc.Appender()
+	if err != nil {
+		return err
+	}
+	p.app = app
+	return nil
+}
+
+func (p *prometheusHistogramChunk) Encoding() Encoding { return PrometheusHistogramChunk }
+
+func (p *prometheusHistogramChunk) Utilization() float64 {
+	return float64(len(p.chunk.Bytes())) / float64(ChunkLen)
+}
+
+func (p *prometheusHistogramChunk) Slice(start, end model.Time) Chunk {
+	// Histogram chunks are append-only and not indexed for slicing; return
+	// the chunk unmodified, same as Bigchunk today.
+	return p
+}
+
+func (p *prometheusHistogramChunk) Len() int {
+	return p.chunk.NumSamples()
+}
+
+func (p *prometheusHistogramChunk) Size() int {
+	return len(p.chunk.Bytes())
+}
+
+func (p *prometheusHistogramChunk) ValueType() ValueType { return ValueHistogram }
+
+// prometheusHistogramIterator adapts chunkenc.Iterator to this package's
+// Iterator interface.
+type prometheusHistogramIterator struct {
+	c    *prometheusHistogramChunk
+	it   chunkenc.Iterator
+	t    model.Time
+	h    *histogram.Histogram
+	fh   *histogram.FloatHistogram
+	kind chunkenc.ValueType
+	err  error
+
+	quarantined bool
+}
+
+func (it *prometheusHistogramIterator) Scan() bool {
+	it.kind = it.it.Next()
+	return it.scanCurrent()
+}
+
+func (it *prometheusHistogramIterator) FindAtOrAfter(t model.Time) bool {
+	it.kind = it.it.Seek(int64(t))
+	return it.scanCurrent()
+}
+
+func (it *prometheusHistogramIterator) scanCurrent() bool {
+	switch it.kind {
+	case chunkenc.ValNone:
+		it.err = it.it.Err()
+		return false
+	case chunkenc.ValHistogram:
+		var ts int64
+		ts, it.h = it.it.AtHistogram(nil)
+		it.fh = nil
+		it.t = model.Time(ts)
+		return true
+	case chunkenc.ValFloatHistogram:
+		var ts int64
+		ts, it.fh = it.it.AtFloatHistogram(nil)
+		it.h = nil
+		it.t = model.Time(ts)
+		return true
+	default:
+		it.err = errors.New("unexpected value type in PrometheusHistogramChunk")
+		return false
+	}
+}
+
+// valueType reports the ValueType of the sample currently held by it.kind:
+// ValueFloatHistogram for a float histogram, ValueHistogram otherwise.
+func (it *prometheusHistogramIterator) valueType() ValueType {
+	if it.kind == chunkenc.ValFloatHistogram {
+		return ValueFloatHistogram
+	}
+	return ValueHistogram
+}
+
+func (it *prometheusHistogramIterator) Value() model.SamplePair {
+	panic("Value called on a histogram chunk iterator, use AtHistogram/AtFloatHistogram")
+}
+
+func (it *prometheusHistogramIterator) AtHistogram() (model.Time, *histogram.Histogram) {
+	return it.t, it.h
+}
+
+func (it *prometheusHistogramIterator) AtFloatHistogram() (model.Time, *histogram.FloatHistogram) {
+	return it.t, it.fh
+}
+
+func (it *prometheusHistogramIterator) Batch(size int) Batch {
+	var batch Batch
+	batch.ValueType = it.valueType()
+	j := 0
+	for j < size {
+		batch.Timestamps[j] = int64(it.t)
+		if it.kind == chunkenc.ValFloatHistogram {
+			batch.PointerValues[j] = unsafe.Pointer(it.fh)
+		} else {
+			batch.PointerValues[j] = unsafe.Pointer(it.h)
+		}
+		j++
+		// Stop on the last filled sample, so the caller's next Scan moves
+		// to the first sample not yet in a batch.
+		if j == size || !it.Scan() {
+			break
+		}
+	}
+	batch.Index = 0
+	batch.Length = j
+	return batch
+}
+
+// FillBatch implements Iterator. It fills out in place rather than building
+// a Batch by value and copying it over, so the histogram path gets the same
+// zero-copy benefit as indexAccessingChunkIterator.
+func (it *prometheusHistogramIterator) FillBatch(from model.Time, out *Batch) bool {
+	if !it.FindAtOrAfter(from) {
+		out.Length = 0
+		return false
+	}
+
+	out.ValueType = it.valueType()
+	j := 0
+	for j < BatchSize {
+		out.Timestamps[j] = int64(it.t)
+		if it.kind == chunkenc.ValFloatHistogram {
+			out.PointerValues[j] = unsafe.Pointer(it.fh)
+		} else {
+			out.PointerValues[j] = unsafe.Pointer(it.h)
+		}
+		j++
+		if !it.Scan() {
+			break
+		}
+	}
+	out.Index = 0
+	out.Length = j
+	return j > 0
+}
+
+// Err implements Iterator. Per the interface contract, a non-nil error here
+// signals data corruption, so it routes the chunk through the installed
+// QuarantineFunc (see SetQuarantineFunc) the first time it's observed.
+func (it *prometheusHistogramIterator) Err() error {
+	if it.err != nil && !it.quarantined {
+		it.quarantined = true
+		quarantine(it.c, it.c.chunk.Bytes(), it.err)
+	}
+	return it.err
+}
@@ -0,0 +1,125 @@
+package encoding
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/histogram"
+)
+
+// Factory creates a new, empty Chunk for a registered Encoding.
+type Factory func() Chunk
+
+type registration struct {
+	name    string
+	factory Factory
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[Encoding]registration{}
+	byName     = map[string]Encoding{}
+)
+
+// Register adds a new chunk encoding under id, addressable by name. It lets
+// downstream projects (Loki, custom forks, ...) plug in their own chunk
+// formats without patching this package. It panics if id is already
+// registered, since that indicates two encodings are fighting over the same
+// on-disk byte.
+func Register(id Encoding, name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if existing, ok := registry[id]; ok {
+		panic(fmt.Sprintf("chunk encoding %d already registered as %q", id, existing.name))
+	}
+	registry[id] = registration{name: name, factory: factory}
+	byName[name] = id
+}
+
+// Lookup returns the factory registered for id, or an error if id is
+// unknown.
+func Lookup(id Encoding) (Factory, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	r, ok := registry[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown chunk encoding: %v", id)
+	}
+	return r.factory, nil
+}
+
+// LookupByName returns the Encoding registered under name, or an error if
+// name is unknown.
+func LookupByName(name string) (Encoding, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	id, ok := byName[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown chunk encoding: %s", name)
+	}
+	return id, nil
+}
+
+// nameForEncoding returns the registered name for id, or its numeric byte
+// as a string if nothing is registered for it yet.
+func nameForEncoding(id Encoding) string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	if r, ok := registry[id]; ok {
+		return r.name
+	}
+	return fmt.Sprintf("%d", byte(id))
+}
+
+// Names returns the names of all registered encodings, sorted, for use in
+// --help output.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// errDeltaReadOnly is returned by readOnlyDeltaChunk's Add/AddHistogram.
+// Delta never needed the overflow-returning Add contract that DoubleDelta,
+// Varbit and Bigchunk implement; rather than keep special-casing it, writes
+// are rejected outright so new samples land on an encoding that's still
+// maintained.
+var errDeltaReadOnly = errors.New("delta chunk encoding is read-only, write with a different encoding")
+
+// readOnlyDeltaChunk wraps a delta-encoded chunk so it can still be read
+// (and its factory keeps registering the Delta id for decoding existing
+// chunks), while rejecting all writes.
+type readOnlyDeltaChunk struct {
+	Chunk
+}
+
+func (d *readOnlyDeltaChunk) Add(model.SamplePair) (Chunk, error) {
+	return nil, errDeltaReadOnly
+}
+
+func (d *readOnlyDeltaChunk) AddHistogram(model.Time, *histogram.Histogram) (Chunk, error) {
+	return nil, errDeltaReadOnly
+}
+
+func init() {
+	Register(Delta, "delta", func() Chunk {
+		return &readOnlyDeltaChunk{Chunk: newDeltaEncodedChunk(d1, d0, true, ChunkLen)}
+	})
+	Register(DoubleDelta, "doubledelta", func() Chunk { return newDoubleDeltaEncodedChunk(d1, d0, true, ChunkLen) })
+	Register(Varbit, "varbit", func() Chunk { return newVarbitChunk(varbitZeroEncoding) })
+	Register(Bigchunk, "bigchunk", func() Chunk { return newBigchunk() })
+	Register(PrometheusHistogramChunk, "histogram", func() Chunk { return newPrometheusHistogramChunk() })
+}